@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/multibuf"
+)
+
+// DefaultCopyBufferBytes is the size of the buffer used to copy a fully
+// buffered response to the client once it has been read out of multibuf.
+const DefaultCopyBufferBytes = 32 * 1024
+
+// BufferPool is the interface stream uses to obtain and release the byte
+// slices it copies bodies through, both while relaying a StreamingMode
+// response and while writing out a fully buffered one. Implementations
+// must be safe for concurrent use by multiple requests.
+type BufferPool interface {
+	// Get returns a buffer of at least size bytes.
+	Get(size int) []byte
+	// Put returns a buffer previously obtained from Get back to the pool.
+	Put(b []byte)
+}
+
+// WithBufferPool sets the BufferPool stream draws its copy buffers from:
+// the StreamingMode relay buffer, the buffer used to copy a fully buffered
+// response out to the client, and the in-memory prefix of a request body
+// that fits within MemRequestBodyBytes (see bufferRequestBody). A request
+// whose body is chunked or larger than MemRequestBodyBytes still has its
+// in-memory portion allocated by multibuf, which doesn't expose a
+// pluggable allocator for that or for its own disk-spill buffers; only
+// byte-slice allocations are pooled, so header maps aren't affected by
+// this option.
+//
+// By default stream uses a sync.Pool-backed pool private to the Streamer;
+// callers that already maintain a pool across several proxies (as grpc-go's
+// mem.BufferPool or a shared Traefik pool would) can plug it in here to cut
+// allocations further.
+func WithBufferPool(p BufferPool) optSetter {
+	return func(s *Streamer) error {
+		s.bufferPool = p
+		return nil
+	}
+}
+
+// NewBufferPool returns the default BufferPool implementation, useful for
+// sharing a single pool across several Streamers via WithBufferPool.
+func NewBufferPool() BufferPool {
+	return newDefaultBufferPool()
+}
+
+// defaultBufferPool buckets buffers by their requested size and recycles
+// each size class through its own sync.Pool, so requests asking for
+// differently sized buffers (e.g. DefaultCopyBufferBytes vs a custom
+// ChunkBufferBytes) don't thrash a single shared pool.
+type defaultBufferPool struct {
+	mu    sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func newDefaultBufferPool() *defaultBufferPool {
+	return &defaultBufferPool{pools: make(map[int]*sync.Pool)}
+}
+
+func (d *defaultBufferPool) poolFor(size int) *sync.Pool {
+	d.mu.Lock()
+	p, ok := d.pools[size]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} { return make([]byte, size) }}
+		d.pools[size] = p
+	}
+	d.mu.Unlock()
+	return p
+}
+
+func (d *defaultBufferPool) Get(size int) []byte {
+	return d.poolFor(size).Get().([]byte)
+}
+
+func (d *defaultBufferPool) Put(b []byte) {
+	d.poolFor(cap(b)).Put(b[:cap(b)])
+}
+
+// pooledRequestBody is a bufferedBody backed by a buffer drawn from a
+// BufferPool instead of a fresh allocation, returned by bufferRequestBody
+// for the common case of a request whose size is known up front and fits
+// within MemRequestBodyBytes.
+type pooledRequestBody struct {
+	pool BufferPool
+	buf  []byte // as returned by pool.Get, recycled on Close
+	data []byte // buf[:n], the portion actually holding the body
+	pos  int64
+}
+
+func (b *pooledRequestBody) Size() (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func (b *pooledRequestBody) Read(p []byte) (int, error) {
+	if b.pos >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.pos:])
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *pooledRequestBody) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset != 0 {
+		return 0, errors.New("stream: pooledRequestBody only supports rewinding to the start")
+	}
+	b.pos = 0
+	return 0, nil
+}
+
+func (b *pooledRequestBody) Close() error {
+	if b.buf != nil {
+		b.pool.Put(b.buf)
+		b.buf = nil
+	}
+	return nil
+}
+
+// bufferRequestBody buffers req's body up to MaxRequestBodyBytes the way
+// multibuf.New does, but serves the common case of a body that's fully
+// known up front -- a non-chunked request no larger than
+// MemRequestBodyBytes -- from the BufferPool instead of a fresh
+// allocation. A chunked body, or one larger than MemRequestBodyBytes,
+// still goes through multibuf, since multibuf owns the decision of when
+// to spill the rest to disk and doesn't accept a preloaded prefix.
+func (s *Streamer) bufferRequestBody(req *http.Request) (bufferedBody, error) {
+	memBytes := s.memRequestBodyBytes
+	if memBytes <= 0 || req.ContentLength < 0 || req.ContentLength > memBytes {
+		return multibuf.New(req.Body, multibuf.MaxBytes(s.maxRequestBodyBytes), multibuf.MemBytes(memBytes))
+	}
+	if s.maxRequestBodyBytes > 0 && req.ContentLength > s.maxRequestBodyBytes {
+		return nil, &multibuf.MaxSizeReachedError{MaxSize: s.maxRequestBodyBytes}
+	}
+
+	buf := s.bufferPool.Get(int(memBytes))
+	n, err := io.ReadFull(req.Body, buf[:req.ContentLength])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		s.bufferPool.Put(buf)
+		return nil, err
+	}
+	return &pooledRequestBody{pool: s.bufferPool, buf: buf, data: buf[:n]}, nil
+}
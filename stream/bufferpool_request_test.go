@@ -0,0 +1,147 @@
+package stream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mailgun/multibuf"
+)
+
+func TestBufferRequestBodyUsesPoolWhenItFits(t *testing.T) {
+	pool := NewBufferPool()
+	s, err := New(http.NotFoundHandler(), WithBufferPool(pool), MemRequestBodyBytes(1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("small body")))
+	body, err := s.bufferRequestBody(req)
+	if err != nil {
+		t.Fatalf("bufferRequestBody: %v", err)
+	}
+	defer body.Close()
+
+	if _, ok := body.(*pooledRequestBody); !ok {
+		t.Fatalf("expected a *pooledRequestBody for a small, known-length body, got %T", body)
+	}
+
+	size, err := body.Size()
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	if size != int64(len("small body")) {
+		t.Fatalf("Size() = %d, want %d", size, len("small body"))
+	}
+
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "small body" {
+		t.Fatalf("got %q, want %q", got, "small body")
+	}
+}
+
+func TestBufferRequestBodySeekRewinds(t *testing.T) {
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("rewind me")))
+	body, err := s.bufferRequestBody(req)
+	if err != nil {
+		t.Fatalf("bufferRequestBody: %v", err)
+	}
+	defer body.Close()
+
+	first, _ := ioutil.ReadAll(body)
+	if _, err := body.Seek(0, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	second, _ := ioutil.ReadAll(body)
+	if !bytes.Equal(first, second) {
+		t.Fatalf("read after Seek(0, start) didn't reproduce the body: %q vs %q", first, second)
+	}
+}
+
+func TestBufferRequestBodyClosePutsBufferBackInPool(t *testing.T) {
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("x")))
+	body, err := s.bufferRequestBody(req)
+	if err != nil {
+		t.Fatalf("bufferRequestBody: %v", err)
+	}
+	pooled, ok := body.(*pooledRequestBody)
+	if !ok {
+		t.Fatalf("expected *pooledRequestBody, got %T", body)
+	}
+	if err := pooled.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if pooled.buf != nil {
+		t.Fatal("expected Close to release the buffer back to the pool")
+	}
+}
+
+func TestBufferRequestBodyFallsBackToMultibufForChunkedBody(t *testing.T) {
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("chunked")))
+	req.ContentLength = -1 // simulate a chunked request, size unknown up front
+
+	body, err := s.bufferRequestBody(req)
+	if err != nil {
+		t.Fatalf("bufferRequestBody: %v", err)
+	}
+	defer body.Close()
+
+	if _, ok := body.(*pooledRequestBody); ok {
+		t.Fatal("a chunked body should go through multibuf, not the pool fast path")
+	}
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "chunked" {
+		t.Fatalf("got %q, want %q", got, "chunked")
+	}
+}
+
+func TestBufferRequestBodyFallsBackWhenOverMemBytes(t *testing.T) {
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(4))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("longer than mem bytes")))
+
+	body, err := s.bufferRequestBody(req)
+	if err != nil {
+		t.Fatalf("bufferRequestBody: %v", err)
+	}
+	defer body.Close()
+
+	if _, ok := body.(*pooledRequestBody); ok {
+		t.Fatal("a body larger than MemRequestBodyBytes should go through multibuf, not the pool fast path")
+	}
+}
+
+func TestBufferRequestBodyRejectsOverMaxBytes(t *testing.T) {
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(1024), MaxRequestBodyBytes(4))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("too long for max")))
+
+	_, err = s.bufferRequestBody(req)
+	if _, ok := err.(*multibuf.MaxSizeReachedError); !ok {
+		t.Fatalf("expected MaxSizeReachedError, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("gzip write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckDecodedSizeRejectsZipBomb(t *testing.T) {
+	// 1MB of zeroes compresses to a tiny gzip stream.
+	plain := bytes.Repeat([]byte{0}, 1<<20)
+	encoded := gzipBytes(t, plain)
+
+	body := &spillBody{mem: encoded, size: int64(len(encoded))}
+	err := checkDecodedSize(body, "gzip", 1024)
+	if _, ok := err.(*MaxDecodedSizeReachedError); !ok {
+		t.Fatalf("expected MaxDecodedSizeReachedError, got %v", err)
+	}
+
+	// body must be rewound regardless of outcome.
+	rewound, rerr := ioutil.ReadAll(body)
+	if rerr != nil {
+		t.Fatalf("reading rewound body: %v", rerr)
+	}
+	if !bytes.Equal(rewound, encoded) {
+		t.Fatal("body was not rewound to its start after rejecting the decoded size")
+	}
+}
+
+func TestCheckDecodedSizeAllowsSmallBody(t *testing.T) {
+	plain := []byte("hello, world")
+	encoded := gzipBytes(t, plain)
+
+	body := &spillBody{mem: encoded, size: int64(len(encoded))}
+	if err := checkDecodedSize(body, "gzip", 1<<20); err != nil {
+		t.Fatalf("expected no error for a body within the limit, got %v", err)
+	}
+
+	rewound, rerr := ioutil.ReadAll(body)
+	if rerr != nil {
+		t.Fatalf("reading rewound body: %v", rerr)
+	}
+	if !bytes.Equal(rewound, encoded) {
+		t.Fatal("body was not rewound to its start")
+	}
+}
+
+func TestCheckDecodedSizeIgnoresUnrecognizedEncoding(t *testing.T) {
+	body := &spillBody{mem: []byte("whatever"), size: 8}
+	if err := checkDecodedSize(body, "br", 1); err != nil {
+		t.Fatalf("expected unrecognized encodings to pass through untouched, got %v", err)
+	}
+}
+
+func TestCheckDecodedSizeRejectsMalformedGzip(t *testing.T) {
+	body := &spillBody{mem: []byte("not actually gzip"), size: 17}
+	err := checkDecodedSize(body, "gzip", 1<<20)
+	de, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("expected *DecodeError for a malformed gzip body, got %v", err)
+	}
+	if de.Encoding != "gzip" {
+		t.Fatalf("DecodeError.Encoding = %q, want %q", de.Encoding, "gzip")
+	}
+
+	rewound, rerr := ioutil.ReadAll(body)
+	if rerr != nil {
+		t.Fatalf("reading rewound body: %v", rerr)
+	}
+	if string(rewound) != "not actually gzip" {
+		t.Fatal("body was not rewound to its start after rejecting the malformed encoding")
+	}
+}
+
+func TestCheckDecodedResponseSizeRejectsZipBomb(t *testing.T) {
+	plain := bytes.Repeat([]byte{0}, 1<<20)
+	encoded := gzipBytes(t, plain)
+
+	r, err := checkDecodedResponseSize(bytes.NewReader(encoded), "gzip", 1024)
+	if _, ok := err.(*MaxDecodedSizeReachedError); !ok {
+		t.Fatalf("expected MaxDecodedSizeReachedError, got %v", err)
+	}
+
+	relayed, rerr := ioutil.ReadAll(r)
+	if rerr != nil {
+		t.Fatalf("reading relayed reader: %v", rerr)
+	}
+	if !bytes.Equal(relayed, encoded) {
+		t.Fatal("relayed bytes should reproduce the original encoded body even when rejected")
+	}
+}
+
+func TestCheckDecodedResponseSizeRelaysUnchanged(t *testing.T) {
+	plain := []byte("a perfectly reasonably sized response body")
+	encoded := gzipBytes(t, plain)
+
+	r, err := checkDecodedResponseSize(bytes.NewReader(encoded), "gzip", 1<<20)
+	if err != nil {
+		t.Fatalf("expected no error for a body within the limit, got %v", err)
+	}
+
+	relayed, rerr := ioutil.ReadAll(r)
+	if rerr != nil {
+		t.Fatalf("reading relayed reader: %v", rerr)
+	}
+	if !bytes.Equal(relayed, encoded) {
+		t.Fatal("relayed bytes should be byte-identical to the original encoded body")
+	}
+
+	// and the relayed bytes should still decode back to the original plaintext.
+	gz, err := gzip.NewReader(bytes.NewReader(relayed))
+	if err != nil {
+		t.Fatalf("relayed bytes aren't valid gzip: %v", err)
+	}
+	decoded, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("decoding relayed bytes: %v", err)
+	}
+	if !bytes.Equal(decoded, plain) {
+		t.Fatal("relayed bytes don't decode back to the original plaintext")
+	}
+}
+
+func TestCheckDecodedResponseSizeNoLimit(t *testing.T) {
+	encoded := gzipBytes(t, []byte("data"))
+	r, err := checkDecodedResponseSize(bytes.NewReader(encoded), "gzip", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r == nil {
+		t.Fatal("expected a reader even with no limit configured")
+	}
+	relayed, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(relayed, encoded) {
+		t.Fatal("expected the original reader back untouched when max <= 0")
+	}
+}
+
@@ -0,0 +1,218 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"strconv"
+
+	"github.com/mailgun/oxy/utils"
+)
+
+// hpredicate is a compiled Retry predicate, evaluated against the context
+// of a single request attempt.
+type hpredicate func(*context) bool
+
+// context carries the state exposed to a Retry predicate while it's being
+// evaluated: the original request, how many attempts have been made so
+// far, the response produced by the last attempt, and a bounded peek into
+// its buffered body so predicates can inspect it without forcing a full
+// read.
+type context struct {
+	r            *http.Request
+	attempt      int
+	responseCode int
+	header       http.Header
+	bodyPeek     []byte
+	sizeLimitErr error
+	log          utils.Logger
+}
+
+// parseExpression compiles a Retry predicate, e.g.
+// `IsNetworkError() && Attempts() <= 2`, into an hpredicate. The predicate
+// is parsed once as a Go expression and evaluated against the request
+// context on every attempt; available functions are documented on Retry.
+func parseExpression(predicate string) (hpredicate, error) {
+	expr, err := parser.ParseExpr(predicate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse predicate %q: %v", predicate, err)
+	}
+	return func(c *context) bool {
+		v, err := evalBool(expr, c)
+		if err != nil {
+			c.log.Errorf("failed to evaluate predicate %q: %v", predicate, err)
+			return false
+		}
+		return v
+	}, nil
+}
+
+func evalBool(expr ast.Expr, c *context) (bool, error) {
+	v, err := evalValue(expr, c)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool expression, got %T", v)
+	}
+	return b, nil
+}
+
+func evalValue(expr ast.Expr, c *context) (interface{}, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return evalValue(e.X, c)
+	case *ast.BasicLit:
+		switch e.Kind {
+		case token.INT:
+			n, err := strconv.Atoi(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			return n, nil
+		case token.STRING:
+			s, err := strconv.Unquote(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			return s, nil
+		default:
+			return nil, fmt.Errorf("unsupported literal %v", e.Value)
+		}
+	case *ast.UnaryExpr:
+		if e.Op != token.NOT {
+			return nil, fmt.Errorf("unsupported unary operator %v", e.Op)
+		}
+		v, err := evalBool(e.X, c)
+		if err != nil {
+			return nil, err
+		}
+		return !v, nil
+	case *ast.BinaryExpr:
+		return evalBinary(e, c)
+	case *ast.CallExpr:
+		return evalCall(e, c)
+	default:
+		return nil, fmt.Errorf("unsupported expression %T", expr)
+	}
+}
+
+func evalBinary(e *ast.BinaryExpr, c *context) (interface{}, error) {
+	switch e.Op {
+	case token.LAND:
+		l, err := evalBool(e.X, c)
+		if err != nil || !l {
+			return false, err
+		}
+		return evalBool(e.Y, c)
+	case token.LOR:
+		l, err := evalBool(e.X, c)
+		if err != nil || l {
+			return l, err
+		}
+		return evalBool(e.Y, c)
+	}
+
+	lv, err := evalValue(e.X, c)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := evalValue(e.Y, c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Op {
+	case token.EQL:
+		return lv == rv, nil
+	case token.NEQ:
+		return lv != rv, nil
+	case token.LSS, token.LEQ, token.GTR, token.GEQ:
+		li, lok := lv.(int)
+		ri, rok := rv.(int)
+		if !lok || !rok {
+			return nil, fmt.Errorf("ordering operators require integer operands, got %T and %T", lv, rv)
+		}
+		switch e.Op {
+		case token.LSS:
+			return li < ri, nil
+		case token.LEQ:
+			return li <= ri, nil
+		case token.GTR:
+			return li > ri, nil
+		default:
+			return li >= ri, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported operator %v", e.Op)
+	}
+}
+
+// evalCall evaluates the predicate functions documented on Retry:
+//
+// Attempts() - returns the number of attempts made so far
+// ResponseCode() - returns the http response code of the last attempt
+// IsNetworkError() - true if the last response code is 502 Bad Gateway or
+//   504 Gateway Timeout
+// Method() - returns the request's HTTP method
+// ResponseHeader(name) - returns a header value from the last response
+// ResponseBodyContains(needle) - true if the buffered response body
+//   contains needle within its first few KB. The body is peeked exactly
+//   as it will be relayed to the client: if the response carries a
+//   Content-Encoding, needle is matched against the still-encoded bytes,
+//   not decoded content, so a predicate like this one practically never
+//   fires against a compressed response.
+// IsDecodedSizeLimit() - true if the response was rejected for decoding
+//   past MaxDecodedResponseBodyBytes, as opposed to some other error
+func evalCall(e *ast.CallExpr, c *context) (interface{}, error) {
+	ident, ok := e.Fun.(*ast.Ident)
+	if !ok {
+		return nil, fmt.Errorf("unsupported call expression")
+	}
+	switch ident.Name {
+	case "Attempts":
+		return c.attempt, nil
+	case "ResponseCode":
+		return c.responseCode, nil
+	case "IsNetworkError":
+		return c.responseCode == http.StatusBadGateway || c.responseCode == http.StatusGatewayTimeout, nil
+	case "Method":
+		return c.r.Method, nil
+	case "ResponseHeader":
+		name, err := stringArg(e, c)
+		if err != nil {
+			return nil, err
+		}
+		return c.header.Get(name), nil
+	case "ResponseBodyContains":
+		needle, err := stringArg(e, c)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Contains(c.bodyPeek, []byte(needle)), nil
+	case "IsDecodedSizeLimit":
+		_, ok := c.sizeLimitErr.(*MaxDecodedSizeReachedError)
+		return ok, nil
+	default:
+		return nil, fmt.Errorf("unknown predicate function %v", ident.Name)
+	}
+}
+
+func stringArg(e *ast.CallExpr, c *context) (string, error) {
+	if len(e.Args) != 1 {
+		return "", fmt.Errorf("%v expects exactly one argument", e.Fun)
+	}
+	v, err := evalValue(e.Args[0], c)
+	if err != nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%v expects a string argument, got %T", e.Fun, v)
+	}
+	return s, nil
+}
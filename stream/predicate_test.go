@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mailgun/oxy/utils"
+)
+
+func evalPredicate(t *testing.T, expr string, c *context) bool {
+	p, err := parseExpression(expr)
+	if err != nil {
+		t.Fatalf("parseExpression(%q): %v", expr, err)
+	}
+	c.log = utils.NullLogger
+	return p(c)
+}
+
+func TestPredicateMethod(t *testing.T) {
+	c := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}}
+	if !evalPredicate(t, `Method() == "GET"`, c) {
+		t.Error(`Method() == "GET" should be true for a GET request`)
+	}
+	if evalPredicate(t, `Method() == "POST"`, c) {
+		t.Error(`Method() == "POST" should be false for a GET request`)
+	}
+}
+
+func TestPredicateResponseHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Upstream-Status", "overloaded")
+	c := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}, header: h}
+	if !evalPredicate(t, `ResponseHeader("X-Upstream-Status") == "overloaded"`, c) {
+		t.Error(`expected ResponseHeader predicate to match`)
+	}
+	if evalPredicate(t, `ResponseHeader("X-Upstream-Status") == "healthy"`, c) {
+		t.Error(`expected ResponseHeader predicate not to match`)
+	}
+}
+
+func TestPredicateResponseBodyContains(t *testing.T) {
+	c := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}, bodyPeek: []byte("internal server error: db timeout")}
+	if !evalPredicate(t, `ResponseBodyContains("db timeout")`, c) {
+		t.Error(`expected ResponseBodyContains predicate to match`)
+	}
+	if evalPredicate(t, `ResponseBodyContains("success")`, c) {
+		t.Error(`expected ResponseBodyContains predicate not to match`)
+	}
+}
+
+func TestPredicateIsDecodedSizeLimit(t *testing.T) {
+	c := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}, sizeLimitErr: &MaxDecodedSizeReachedError{MaxSize: 100}}
+	if !evalPredicate(t, `IsDecodedSizeLimit()`, c) {
+		t.Error(`expected IsDecodedSizeLimit predicate to match a MaxDecodedSizeReachedError`)
+	}
+
+	c2 := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}}
+	if evalPredicate(t, `IsDecodedSizeLimit()`, c2) {
+		t.Error(`expected IsDecodedSizeLimit predicate not to match when sizeLimitErr is nil`)
+	}
+}
+
+func TestPredicateCombination(t *testing.T) {
+	c := &context{r: &http.Request{Method: "GET", URL: &url.URL{}}, attempt: 2, responseCode: 502}
+	if !evalPredicate(t, `Attempts() <= 2 && ResponseCode() == 502`, c) {
+		t.Error(`expected combined predicate to match`)
+	}
+}
@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryBackoff sets the exponential backoff applied between retry attempts:
+// the first retry waits initial, and each subsequent one doubles the wait
+// up to max. jitter, in the range [0, 1], adds up to that fraction of
+// additional random delay on top of each wait so that retries from many
+// concurrent requests don't all land on the upstream at once.
+//
+// Without RetryBackoff, retries are attempted immediately.
+func RetryBackoff(initial, max time.Duration, jitter float64) optSetter {
+	return func(s *Streamer) error {
+		if initial <= 0 {
+			return fmt.Errorf("initial backoff should be > 0 got %v", initial)
+		}
+		if max < initial {
+			return fmt.Errorf("max backoff %v should be >= initial backoff %v", max, initial)
+		}
+		if jitter < 0 || jitter > 1 {
+			return fmt.Errorf("jitter should be in range [0, 1] got %v", jitter)
+		}
+		s.retryBackoffInitial = initial
+		s.retryBackoffMax = max
+		s.retryBackoffJitter = jitter
+		return nil
+	}
+}
+
+// RetryBudget sets the total amount of time the streamer is allowed to
+// spend retrying a single request, measured from the first attempt. Once
+// the budget is exceeded no further attempts are made and the last
+// response received is returned to the client, regardless of what the
+// Retry predicate says.
+func RetryBudget(d time.Duration) optSetter {
+	return func(s *Streamer) error {
+		if d <= 0 {
+			return fmt.Errorf("retry budget should be > 0 got %v", d)
+		}
+		s.retryBudget = d
+		return nil
+	}
+}
+
+// backoffDelay returns how long to wait before the given attempt, or 0 if
+// RetryBackoff hasn't been configured.
+func (s *Streamer) backoffDelay(attempt int) time.Duration {
+	if s.retryBackoffInitial <= 0 {
+		return 0
+	}
+	d := s.retryBackoffInitial
+	for i := 1; i < attempt-1; i++ {
+		d *= 2
+		if d >= s.retryBackoffMax {
+			d = s.retryBackoffMax
+			break
+		}
+	}
+	if d > s.retryBackoffMax {
+		d = s.retryBackoffMax
+	}
+	if s.retryBackoffJitter > 0 {
+		d += time.Duration(s.retryBackoffJitter * float64(d) * rand.Float64())
+	}
+	return d
+}
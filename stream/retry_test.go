@@ -0,0 +1,81 @@
+package stream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestStreamer(t *testing.T, setters ...optSetter) *Streamer {
+	s, err := New(http.NotFoundHandler(), setters...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func TestBackoffDelayDisabledByDefault(t *testing.T) {
+	s := newTestStreamer(t)
+	for attempt := 1; attempt <= 3; attempt++ {
+		if d := s.backoffDelay(attempt); d != 0 {
+			t.Errorf("backoffDelay(%d) = %v, want 0 without RetryBackoff", attempt, d)
+		}
+	}
+}
+
+func TestBackoffDelayDoublesUpToMax(t *testing.T) {
+	s := newTestStreamer(t, RetryBackoff(10*time.Millisecond, 80*time.Millisecond, 0))
+
+	want := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		80 * time.Millisecond,
+		80 * time.Millisecond, // capped at max
+	}
+	for i, w := range want {
+		attempt := i + 2 // attempt 1 is the first try, backoff applies from the first retry (attempt 2) on
+		if d := s.backoffDelay(attempt); d != w {
+			t.Errorf("backoffDelay(%d) = %v, want %v", attempt, d, w)
+		}
+	}
+}
+
+func TestBackoffDelayJitterAddsUpToFraction(t *testing.T) {
+	s := newTestStreamer(t, RetryBackoff(100*time.Millisecond, 100*time.Millisecond, 0.5))
+	for i := 0; i < 20; i++ {
+		d := s.backoffDelay(2)
+		if d < 100*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("backoffDelay with jitter = %v, want in [100ms, 150ms]", d)
+		}
+	}
+}
+
+func TestRetryBackoffValidation(t *testing.T) {
+	cases := []struct {
+		name         string
+		initial, max time.Duration
+		jitter       float64
+	}{
+		{"zero initial", 0, time.Second, 0},
+		{"max below initial", 2 * time.Second, time.Second, 0},
+		{"jitter out of range", time.Second, time.Second, 1.5},
+	}
+	for _, c := range cases {
+		if _, err := New(http.NotFoundHandler(), RetryBackoff(c.initial, c.max, c.jitter)); err == nil {
+			t.Errorf("%s: expected error, got nil", c.name)
+		}
+	}
+}
+
+func TestRetryBudgetValidation(t *testing.T) {
+	if _, err := New(http.NotFoundHandler(), RetryBudget(0)); err == nil {
+		t.Error("RetryBudget(0): expected error, got nil")
+	}
+	if _, err := New(http.NotFoundHandler(), RetryBudget(-time.Second)); err == nil {
+		t.Error("RetryBudget(-1s): expected error, got nil")
+	}
+	if _, err := New(http.NotFoundHandler(), RetryBudget(time.Second)); err != nil {
+		t.Errorf("RetryBudget(1s): unexpected error: %v", err)
+	}
+}
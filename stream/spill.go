@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/mailgun/multibuf"
+)
+
+// SpillWriter is handed back by SpillStore.NewWriter. Besides the usual
+// io.WriteCloser, it exposes the ID under which the spilled data can later
+// be reopened via SpillStore.Open, and a Discard method for abandoning the
+// spill.
+type SpillWriter interface {
+	io.WriteCloser
+	ID() string
+	// Discard abandons the spill: it deletes whatever's been written so
+	// far and releases any quota the store reserved for it. Callers must
+	// use Discard instead of Close whenever the spill won't go on to a
+	// successful SpillStore.Open, e.g. because the request body turned
+	// out to be oversized or the client disconnected mid-upload.
+	Discard() error
+}
+
+// SpillStore is the pluggable disk-spill backend stream uses to persist
+// the portion of a request body that doesn't fit within
+// MemRequestBodyBytes. stream ships three implementations:
+// NewTmpfsSpillStore (quota-bounded tmpfs), NewEncryptedSpillStore
+// (AES-GCM at rest, wrapping another store) and NewMemorySpillStore (fails
+// fast instead of spilling, for read-only-rootfs deployments).
+type SpillStore interface {
+	// NewWriter opens a new spill, identified by the returned SpillWriter's ID.
+	NewWriter(ctx context.Context) (SpillWriter, error)
+	// Open reopens a previously written spill for replay.
+	Open(id string) (io.ReadSeekCloser, error)
+}
+
+// WithSpillStore sets the SpillStore used to persist request bodies that
+// exceed MemRequestBodyBytes, instead of the default of spooling to a file
+// in os.TempDir via multibuf.
+func WithSpillStore(store SpillStore) optSetter {
+	return func(s *Streamer) error {
+		s.spillStore = store
+		return nil
+	}
+}
+
+// ErrSpillNotSupported is returned by a SpillStore that refuses to spill,
+// e.g. NewMemorySpillStore once its in-memory budget is exhausted.
+var ErrSpillNotSupported = errors.New("stream: body exceeds the in-memory limit and spilling to disk is not supported")
+
+// bufferedBody is what ServeHTTP needs from a buffered request body,
+// whether it came from multibuf or from a SpillStore: a replayable,
+// sized reader.
+type bufferedBody interface {
+	io.ReadCloser
+	Seek(offset int64, whence int) (int64, error)
+	Size() (int64, error)
+}
+
+// spillBody is a bufferedBody backed by an in-memory prefix of up to
+// memBytes, with any overflow persisted through a SpillStore.
+type spillBody struct {
+	mem   []byte
+	size  int64
+	pos   int64
+	spill io.ReadSeekCloser
+}
+
+func (b *spillBody) Size() (int64, error) {
+	return b.size, nil
+}
+
+func (b *spillBody) Read(p []byte) (int, error) {
+	if b.pos < int64(len(b.mem)) {
+		n := copy(p, b.mem[b.pos:])
+		b.pos += int64(n)
+		return n, nil
+	}
+	if b.spill == nil {
+		return 0, io.EOF
+	}
+	n, err := b.spill.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *spillBody) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || offset != 0 {
+		return 0, errors.New("stream: spillBody only supports rewinding to the start")
+	}
+	b.pos = 0
+	if b.spill != nil {
+		if _, err := b.spill.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+func (b *spillBody) Close() error {
+	if b.spill != nil {
+		return b.spill.Close()
+	}
+	return nil
+}
+
+// bufferWithSpillStore reads r into an in-memory prefix of up to memBytes,
+// and once that's exhausted spills the remainder through store, rejecting
+// the request with a MaxSizeReachedError if the total exceeds maxBytes (a
+// maxBytes <= 0 means no limit).
+func (s *Streamer) bufferWithSpillStore(ctx context.Context, r io.Reader) (*spillBody, error) {
+	memBytes := s.memRequestBodyBytes
+	maxBytes := s.maxRequestBodyBytes
+
+	mem := make([]byte, 0, memBytes)
+	if memBytes > 0 {
+		buf := make([]byte, memBytes)
+		n, err := io.ReadFull(r, buf)
+		mem = buf[:n]
+		if maxBytes > 0 && int64(len(mem)) > maxBytes {
+			return nil, &multibuf.MaxSizeReachedError{MaxSize: maxBytes}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &spillBody{mem: mem, size: int64(len(mem))}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The prefix is full; only spill if there's at least one more byte.
+		var next [1]byte
+		m, perr := io.ReadFull(r, next[:])
+		if m == 0 {
+			if perr != io.EOF {
+				return nil, perr
+			}
+			return &spillBody{mem: mem, size: int64(len(mem))}, nil
+		}
+		r = io.MultiReader(bytes.NewReader(next[:]), r)
+	}
+
+	// There's more to read than fits in memory: spill the remainder.
+	w, err := s.spillStore.NewWriter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(len(mem))
+	chunk := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(chunk)
+		if n > 0 {
+			total += int64(n)
+			if maxBytes > 0 && total > maxBytes {
+				w.Discard()
+				return nil, &multibuf.MaxSizeReachedError{MaxSize: maxBytes}
+			}
+			if _, werr := w.Write(chunk[:n]); werr != nil {
+				w.Discard()
+				return nil, werr
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			w.Discard()
+			return nil, rerr
+		}
+	}
+
+	id := w.ID()
+	if err := w.Close(); err != nil {
+		w.Discard()
+		return nil, err
+	}
+
+	spillReader, err := s.spillStore.Open(id)
+	if err != nil {
+		w.Discard()
+		return nil, err
+	}
+
+	return &spillBody{mem: mem, size: total, spill: spillReader}, nil
+}
@@ -0,0 +1,166 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func newTestEncryptedStore(t *testing.T) SpillStore {
+	dir, err := ioutil.TempDir("", "oxy-spill-encrypted-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	key := bytes.Repeat([]byte{0x42}, 32) // AES-256
+	store, err := NewEncryptedSpillStore(NewTmpfsSpillStore(dir, 0, 0), key)
+	if err != nil {
+		t.Fatalf("NewEncryptedSpillStore: %v", err)
+	}
+	return store
+}
+
+func writeSpill(t *testing.T, store SpillStore, plaintext []byte) string {
+	w, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return w.ID()
+}
+
+func TestEncryptedSpillRoundTrip(t *testing.T) {
+	store := newTestEncryptedStore(t)
+
+	// Exercise more than one chunk's worth of plaintext (encryptedSpillChunkSize is 64KB).
+	plaintext := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog"), 5000)
+
+	id := writeSpill(t, store, plaintext)
+
+	r, err := store.Open(id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatal("round-tripped plaintext doesn't match what was written")
+	}
+}
+
+func TestEncryptedSpillSeekToStart(t *testing.T) {
+	store := newTestEncryptedStore(t)
+	plaintext := []byte("rewind me please")
+	id := writeSpill(t, store, plaintext)
+
+	r, err := store.Open(id)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+
+	first, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("first ReadAll: %v", err)
+	}
+	if !bytes.Equal(first, plaintext) {
+		t.Fatal("first read didn't reproduce the plaintext")
+	}
+
+	if _, err := r.Seek(0, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	second, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("second ReadAll: %v", err)
+	}
+	if !bytes.Equal(second, plaintext) {
+		t.Fatal("read after Seek(0, start) didn't reproduce the plaintext")
+	}
+}
+
+func TestEncryptedSpillDistinctSpillsDontReuseNonce(t *testing.T) {
+	store := newTestEncryptedStore(t)
+	plaintext := bytes.Repeat([]byte{0xAB}, 128*1024) // spans multiple chunks
+
+	id1 := writeSpill(t, store, plaintext)
+	id2 := writeSpill(t, store, plaintext)
+
+	// Read the raw ciphertext (framed nonce || length || chunk) straight
+	// off disk, bypassing the encryption layer, to confirm two spills of
+	// the exact same plaintext never produce the exact same bytes on
+	// disk -- which they would if the same (key, nonce) pair were ever
+	// reused.
+	inner := store.(*encryptedSpillStore).inner
+	r1, err := inner.Open(id1)
+	if err != nil {
+		t.Fatalf("inner.Open(id1): %v", err)
+	}
+	defer r1.Close()
+	r2, err := inner.Open(id2)
+	if err != nil {
+		t.Fatalf("inner.Open(id2): %v", err)
+	}
+	defer r2.Close()
+
+	raw1, err := ioutil.ReadAll(r1)
+	if err != nil {
+		t.Fatalf("ReadAll(raw1): %v", err)
+	}
+	raw2, err := ioutil.ReadAll(r2)
+	if err != nil {
+		t.Fatalf("ReadAll(raw2): %v", err)
+	}
+	if bytes.Equal(raw1, raw2) {
+		t.Fatal("two spills of identical plaintext produced identical ciphertext -- the per-chunk nonce didn't vary")
+	}
+}
+
+func TestEncryptedSpillChunksWithinASpillHaveDistinctNonces(t *testing.T) {
+	store := newTestEncryptedStore(t)
+	// Three chunk's worth, so flushChunk runs more than once.
+	plaintext := bytes.Repeat([]byte{0xCD}, 3*encryptedSpillChunkSize)
+	id := writeSpill(t, store, plaintext)
+
+	inner := store.(*encryptedSpillStore).inner
+	r, err := inner.Open(id)
+	if err != nil {
+		t.Fatalf("inner.Open: %v", err)
+	}
+	defer r.Close()
+
+	nonceSize := store.(*encryptedSpillStore).aead.NonceSize()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		nonce := make([]byte, nonceSize)
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			t.Fatalf("reading nonce %d: %v", i, err)
+		}
+		if seen[string(nonce)] {
+			t.Fatalf("chunk %d reused a nonce already seen in this spill", i)
+		}
+		seen[string(nonce)] = true
+
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			t.Fatalf("reading length %d: %v", i, err)
+		}
+		ct := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r, ct); err != nil {
+			t.Fatalf("reading ciphertext %d: %v", i, err)
+		}
+	}
+}
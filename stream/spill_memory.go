@@ -0,0 +1,29 @@
+package stream
+
+import (
+	"context"
+	"io"
+)
+
+// memorySpillStore never spills to disk: NewWriter always fails with
+// ErrSpillNotSupported, so a body that doesn't fit within
+// MemRequestBodyBytes is rejected outright instead of being written out.
+// Use it in read-only-rootfs containers, where there's nowhere to spill to
+// in the first place.
+type memorySpillStore struct{}
+
+// NewMemorySpillStore returns a SpillStore that refuses to spill. Combine
+// it with a generous MemRequestBodyBytes to bound memory usage while still
+// rejecting outsized requests instead of silently trying to write to a
+// filesystem that may not be writable.
+func NewMemorySpillStore() SpillStore {
+	return memorySpillStore{}
+}
+
+func (memorySpillStore) NewWriter(ctx context.Context) (SpillWriter, error) {
+	return nil, ErrSpillNotSupported
+}
+
+func (memorySpillStore) Open(id string) (io.ReadSeekCloser, error) {
+	return nil, ErrSpillNotSupported
+}
@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TmpfsSpillStore spills bodies to files under Dir, rejecting new spills
+// once the configured byte or file budget would be exceeded. It's meant
+// for tmpfs-backed directories, where both are finite host resources
+// shared across every request the process handles concurrently, so a
+// single oversized upload can't starve the rest of the pod.
+type TmpfsSpillStore struct {
+	Dir           string
+	MaxTotalBytes int64
+	MaxFiles      int
+
+	mu        sync.Mutex
+	usedBytes int64
+	usedFiles int
+}
+
+// NewTmpfsSpillStore returns a SpillStore that writes spills as files
+// under dir, rejecting new ones once doing so would push the running
+// total over maxTotalBytes bytes or maxFiles concurrently open spills. A
+// limit of 0 means unbounded.
+func NewTmpfsSpillStore(dir string, maxTotalBytes int64, maxFiles int) *TmpfsSpillStore {
+	return &TmpfsSpillStore{Dir: dir, MaxTotalBytes: maxTotalBytes, MaxFiles: maxFiles}
+}
+
+func (t *TmpfsSpillStore) NewWriter(ctx context.Context) (SpillWriter, error) {
+	t.mu.Lock()
+	if t.MaxFiles > 0 && t.usedFiles >= t.MaxFiles {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("stream: tmpfs spill store is at its %d file quota", t.MaxFiles)
+	}
+	t.usedFiles++
+	t.mu.Unlock()
+
+	f, err := ioutil.TempFile(t.Dir, "oxy-spill-")
+	if err != nil {
+		t.mu.Lock()
+		t.usedFiles--
+		t.mu.Unlock()
+		return nil, err
+	}
+	return &tmpfsSpillWriter{store: t, file: f}, nil
+}
+
+func (t *TmpfsSpillStore) Open(id string) (io.ReadSeekCloser, error) {
+	path := filepath.Join(t.Dir, filepath.Base(id))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tmpfsSpillReader{File: f, store: t, size: info.Size()}, nil
+}
+
+func (t *TmpfsSpillStore) release(n int64) {
+	t.mu.Lock()
+	t.usedBytes -= n
+	t.usedFiles--
+	t.mu.Unlock()
+}
+
+type tmpfsSpillWriter struct {
+	store      *TmpfsSpillStore
+	file       *os.File
+	written    int64
+	fileClosed bool // guards against closing the *os.File twice
+	discarded  bool // guards against releasing the quota twice
+}
+
+func (w *tmpfsSpillWriter) Write(p []byte) (int, error) {
+	w.store.mu.Lock()
+	if w.store.MaxTotalBytes > 0 && w.store.usedBytes+int64(len(p)) > w.store.MaxTotalBytes {
+		w.store.mu.Unlock()
+		return 0, fmt.Errorf("stream: tmpfs spill store is at its %d byte quota", w.store.MaxTotalBytes)
+	}
+	w.store.usedBytes += int64(len(p))
+	w.store.mu.Unlock()
+
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *tmpfsSpillWriter) ID() string {
+	return filepath.Base(w.file.Name())
+}
+
+// Close commits the spill: it flushes and closes the backing file,
+// leaving it on disk ready to be reopened via SpillStore.Open. It
+// intentionally does not release the quota slot -- Close on its own
+// doesn't tell us whether the spill will go on to a successful Open, so
+// only Discard (see below) or a successful reader's Close do that.
+func (w *tmpfsSpillWriter) Close() error {
+	if w.fileClosed {
+		return nil
+	}
+	w.fileClosed = true
+	return w.file.Close()
+}
+
+// Discard abandons the spill: it closes the file if Close hasn't
+// already, deletes it and releases its share of the quota. It's safe to
+// call after a successful Close too -- e.g. when a subsequent
+// SpillStore.Open fails -- which is why it doesn't share Close's guard:
+// use Discard instead of, or in addition to, Close whenever the spill
+// won't go on to a successful Open, e.g. because the request body turned
+// out to be oversized, the client disconnected mid-upload, or Open
+// itself failed. Otherwise the file and its quota slot leak forever,
+// since only the reader returned by Open releases them on the success
+// path.
+func (w *tmpfsSpillWriter) Discard() error {
+	if w.discarded {
+		return nil
+	}
+	w.discarded = true
+
+	var err error
+	if !w.fileClosed {
+		w.fileClosed = true
+		err = w.file.Close()
+	}
+	path := w.file.Name()
+	os.Remove(path)
+	w.store.release(w.written)
+	return err
+}
+
+// tmpfsSpillReader deletes its backing file and releases its share of the
+// quota once closed, since by then the streamer is done replaying it.
+type tmpfsSpillReader struct {
+	*os.File
+	store  *TmpfsSpillStore
+	size   int64
+	closed bool
+}
+
+func (r *tmpfsSpillReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	path := r.File.Name()
+	err := r.File.Close()
+	os.Remove(path)
+	r.store.release(r.size)
+	return err
+}
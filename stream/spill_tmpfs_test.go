@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func newTestTmpfsStore(t *testing.T, maxTotalBytes int64, maxFiles int) (*TmpfsSpillStore, string) {
+	dir, err := ioutil.TempDir("", "oxy-tmpfs-spill-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return NewTmpfsSpillStore(dir, maxTotalBytes, maxFiles), dir
+}
+
+func dirEntries(t *testing.T, dir string) []os.FileInfo {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	return entries
+}
+
+func TestTmpfsSpillStoreRoundTrip(t *testing.T) {
+	store, dir := newTestTmpfsStore(t, 0, 0)
+
+	w, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("hello spill")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := store.Open(w.ID())
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello spill" {
+		t.Fatalf("got %q, want %q", got, "hello spill")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("reader Close: %v", err)
+	}
+
+	if store.usedFiles != 0 || store.usedBytes != 0 {
+		t.Fatalf("expected quota fully released after the reader is closed, got usedFiles=%d usedBytes=%d", store.usedFiles, store.usedBytes)
+	}
+	if entries := dirEntries(t, dir); len(entries) != 0 {
+		t.Fatalf("expected the spill file to be deleted once the reader closed, found %d entries", len(entries))
+	}
+}
+
+func TestTmpfsSpillStoreRejectsOverFileQuota(t *testing.T) {
+	store, _ := newTestTmpfsStore(t, 0, 1)
+
+	w1, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("first NewWriter: %v", err)
+	}
+	defer w1.Discard()
+
+	if _, err := store.NewWriter(context.Background()); err == nil {
+		t.Fatal("expected NewWriter to fail once the file quota is exhausted")
+	}
+}
+
+func TestTmpfsSpillStoreRejectsOverByteQuota(t *testing.T) {
+	store, _ := newTestTmpfsStore(t, 4, 0)
+
+	w, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	defer w.Discard()
+
+	if _, err := w.Write([]byte("way too many bytes")); err == nil {
+		t.Fatal("expected Write to fail once it would exceed the byte quota")
+	}
+}
+
+func TestTmpfsSpillStoreDiscardReleasesQuotaAndDeletesFile(t *testing.T) {
+	store, dir := newTestTmpfsStore(t, 0, 0)
+
+	w, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("abandoned")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := w.Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+
+	if store.usedFiles != 0 || store.usedBytes != 0 {
+		t.Fatalf("expected quota released after Discard, got usedFiles=%d usedBytes=%d", store.usedFiles, store.usedBytes)
+	}
+	if entries := dirEntries(t, dir); len(entries) != 0 {
+		t.Fatalf("expected Discard to delete the spill file, found %d entries", len(entries))
+	}
+
+	// Discard must be idempotent: a second call shouldn't double-release the quota.
+	if err := w.Discard(); err != nil {
+		t.Fatalf("second Discard: %v", err)
+	}
+	if store.usedFiles != 0 || store.usedBytes != 0 {
+		t.Fatalf("a second Discard call double-released the quota: usedFiles=%d usedBytes=%d", store.usedFiles, store.usedBytes)
+	}
+}
+
+// TestTmpfsSpillStoreDiscardAfterCloseReleasesQuota exercises the case a
+// prior review flagged: bufferWithSpillStore calls Close successfully and
+// then SpillStore.Open fails (or Close itself errors). Discard must still
+// be able to clean up even though the writer already reports itself closed.
+func TestTmpfsSpillStoreDiscardAfterCloseReleasesQuota(t *testing.T) {
+	store, dir := newTestTmpfsStore(t, 0, 0)
+
+	w, err := store.NewWriter(context.Background())
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if _, err := w.Write([]byte("committed then abandoned")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Simulate SpillStore.Open failing after a successful Close.
+	if err := w.Discard(); err != nil {
+		t.Fatalf("Discard after Close: %v", err)
+	}
+
+	if store.usedFiles != 0 || store.usedBytes != 0 {
+		t.Fatalf("expected quota released by Discard even after a successful Close, got usedFiles=%d usedBytes=%d", store.usedFiles, store.usedBytes)
+	}
+	if entries := dirEntries(t, dir); len(entries) != 0 {
+		t.Fatalf("expected Discard to delete the spill file even after a successful Close, found %d entries", len(entries))
+	}
+}
+
+// failOpenSpillStore wraps a real SpillStore but always fails Open, so
+// tests can deterministically exercise the "Close succeeded, Open failed"
+// path in bufferWithSpillStore without racing the filesystem.
+type failOpenSpillStore struct {
+	SpillStore
+}
+
+func (failOpenSpillStore) Open(id string) (io.ReadSeekCloser, error) {
+	return nil, errors.New("forced Open failure")
+}
+
+func TestBufferWithSpillStoreDiscardsOnOpenFailure(t *testing.T) {
+	tmpfs, dir := newTestTmpfsStore(t, 0, 0)
+
+	s, err := New(http.NotFoundHandler(), MemRequestBodyBytes(0), WithSpillStore(failOpenSpillStore{tmpfs}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	_, err = s.bufferWithSpillStore(context.Background(), bytes.NewReader([]byte("spill this")))
+	if err == nil {
+		t.Fatal("expected bufferWithSpillStore to surface the Open failure")
+	}
+
+	if tmpfs.usedFiles != 0 || tmpfs.usedBytes != 0 {
+		t.Fatalf("Open failing after a successful Close leaked quota: usedFiles=%d usedBytes=%d", tmpfs.usedFiles, tmpfs.usedBytes)
+	}
+	if entries := dirEntries(t, dir); len(entries) != 0 {
+		t.Fatalf("Open failing after a successful Close leaked the spill file, found %d entries", len(entries))
+	}
+}
@@ -32,13 +32,36 @@ Examples of a streaming middleware:
   // before returning the response
   stream.New(handler, stream.Retry(`IsNetworkError() && Attempts() <= 2`))
 
+  // StreamingMode relays large requests and responses straight through in
+  // fixed-size chunks instead of buffering them in full, at the cost of
+  // giving up Retry (a streamed request can no longer be replayed)
+  stream.New(handler, stream.StreamingMode(true))
+
+  // Share a single buffer pool across several Streamers to cut down on
+  // allocations under high request rates
+  pool := stream.NewBufferPool()
+  stream.New(handler, stream.WithBufferPool(pool))
+
+  // Spill request bodies larger than MemRequestBodyBytes to a quota-bounded
+  // tmpfs directory instead of the default of an unbounded os.TempDir file
+  store := stream.NewTmpfsSpillStore("/tmpfs/oxy", 1<<30, 1000)
+  stream.New(handler, stream.WithSpillStore(store))
+
+  // Reject a gzip-encoded request or response that would decode to more
+  // than 50MB, guarding against zip-bomb style payloads
+  stream.New(handler,
+    stream.MaxDecodedRequestBodyBytes(50 * 1024 * 1024),
+    stream.MaxDecodedResponseBodyBytes(50 * 1024 * 1024))
+
 */
 package stream
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/mailgun/multibuf"
 	"github.com/mailgun/oxy/utils"
@@ -64,8 +87,22 @@ type Streamer struct {
 	maxResponseBodyBytes int64
 	memResponseBodyBytes int64
 
+	maxDecodedRequestBodyBytes  int64
+	maxDecodedResponseBodyBytes int64
+
 	retryPredicate hpredicate
 
+	retryBackoffInitial time.Duration
+	retryBackoffMax     time.Duration
+	retryBackoffJitter  float64
+	retryBudget         time.Duration
+
+	streamingMode    bool
+	chunkBufferBytes int
+
+	bufferPool BufferPool
+	spillStore SpillStore
+
 	next       http.Handler
 	errHandler utils.ErrorHandler
 	log        utils.Logger
@@ -95,6 +132,14 @@ func New(next http.Handler, setters ...optSetter) (*Streamer, error) {
 		strm.log = utils.NullLogger
 	}
 
+	if strm.streamingMode && strm.chunkBufferBytes == 0 {
+		strm.chunkBufferBytes = DefaultChunkBufferBytes
+	}
+
+	if strm.bufferPool == nil {
+		strm.bufferPool = newDefaultBufferPool()
+	}
+
 	return strm, nil
 }
 
@@ -106,11 +151,19 @@ type optSetter func(s *Streamer) error
 // Attempts() - limits the amount of retry attempts
 // ResponseCode() - returns http response code
 // IsNetworkError() - tests if response code is related to networking error
+// Method() - returns the request's HTTP method, useful to only retry idempotent requests
+// ResponseHeader(name) - returns a header value from the last response
+// ResponseBodyContains(needle) - tests if the buffered response body contains needle;
+//   note this matches against the still-encoded bytes when the response carries a
+//   Content-Encoding, so it won't match human-readable needles against a compressed body
+// IsDecodedSizeLimit() - tests if the response was rejected for exceeding MaxDecodedResponseBodyBytes
 //
 // Example of the predicate:
 //
 // `Attempts() <= 2 && ResponseCode() == 502`
 //
+// `Method() == "GET" && ResponseHeader("X-Upstream-Status") == "overloaded"`
+//
 func Retry(predicate string) optSetter {
 	return func(s *Streamer) error {
 		p, err := parseExpression(predicate)
@@ -191,6 +244,14 @@ func (s *Streamer) Wrap(next http.Handler) error {
 }
 
 func (s *Streamer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Streaming mode relays the body straight through instead of buffering
+	// it, which means it cannot be replayed; fall back to the regular
+	// buffering behavior whenever a retry predicate is configured.
+	if s.streamingMode && s.retryPredicate == nil {
+		s.serveStreaming(w, req)
+		return
+	}
+
 	if err := s.checkLimit(req); err != nil {
 		s.log.Infof("request body over limit: %v", err)
 		s.errHandler.ServeHTTP(w, req, err)
@@ -201,7 +262,17 @@ func (s *Streamer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// to read into memory and disk. This reader returns an error if the total request size exceeds the
 	// prefefined MaxSizeBytes. This can occur if we got chunked request, in this case ContentLength would be set to -1
 	// and the reader would be unbounded bufio in the http.Server
-	body, err := multibuf.New(req.Body, multibuf.MaxBytes(s.maxRequestBodyBytes), multibuf.MemBytes(s.memRequestBodyBytes))
+	//
+	// By default the overflow beyond memRequestBodyBytes is spooled to
+	// os.TempDir by multibuf; when a SpillStore is configured it is used
+	// instead, so operators can enforce disk quotas or encrypt spilled data.
+	var body bufferedBody
+	var err error
+	if s.spillStore != nil {
+		body, err = s.bufferWithSpillStore(req.Context(), req.Body)
+	} else {
+		body, err = s.bufferRequestBody(req)
+	}
 	if err != nil || body == nil {
 		s.errHandler.ServeHTTP(w, req, err)
 		return
@@ -221,8 +292,18 @@ func (s *Streamer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// MaxRequestBodyBytes above only bounds the bytes as received; guard
+	// against a small, highly compressed body separately, to catch
+	// zip-bomb style payloads before they ever reach the handler.
+	if err := checkDecodedSize(body, req.Header.Get("Content-Encoding"), s.maxDecodedRequestBodyBytes); err != nil {
+		s.log.Infof("request body over decoded limit: %v", err)
+		s.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
 	outreq := s.copyRequest(req, body, totalSize)
 
+	start := time.Now()
 	attempt := 1
 	for {
 		// We create a special writer that will limit the response size, buffer it to disk if necessary
@@ -251,11 +332,44 @@ func (s *Streamer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		defer reader.Close()
 
-		if (s.retryPredicate == nil || attempt > DefaultMaxRetryAttempts) ||
-			!s.retryPredicate(&context{r: req, attempt: attempt, responseCode: b.code, log: s.log}) {
+		// Guard against an upstream returning a small, highly compressed
+		// body that decodes to something far larger than the client
+		// should receive. Unlike other fatal errors, this one is still
+		// handed to the retry predicate: an operator may want to retry a
+		// misbehaving upstream rather than fail the request outright.
+		decoded, sizeLimitErr := checkDecodedResponseSize(reader, b.Header().Get("Content-Encoding"), s.maxDecodedResponseBodyBytes)
+		if sizeLimitErr != nil {
+			if _, ok := sizeLimitErr.(*MaxDecodedSizeReachedError); !ok {
+				s.log.Errorf("failed to check decoded response size, err %v", sizeLimitErr)
+				s.errHandler.ServeHTTP(w, req, sizeLimitErr)
+				return
+			}
+		}
+
+		peek, rewound, peekErr := peekReader(decoded, retryPredicatePeekBytes)
+		if peekErr != nil {
+			s.log.Errorf("failed to peek response, err %v", peekErr)
+			s.errHandler.ServeHTTP(w, req, peekErr)
+			return
+		}
+
+		// The wait before the next attempt counts against the budget too, so
+		// no attempt starts once the budget has run out.
+		delay := s.backoffDelay(attempt + 1)
+		overBudget := s.retryBudget > 0 && time.Since(start)+delay > s.retryBudget
+
+		ctx := &context{r: req, attempt: attempt, responseCode: b.code, header: b.Header(), bodyPeek: peek, sizeLimitErr: sizeLimitErr, log: s.log}
+		if (s.retryPredicate == nil || attempt > DefaultMaxRetryAttempts || overBudget) ||
+			!s.retryPredicate(ctx) {
+			if sizeLimitErr != nil {
+				s.errHandler.ServeHTTP(w, req, sizeLimitErr)
+				return
+			}
 			copyHeaders(w.Header(), b.Header())
 			w.WriteHeader(b.code)
-			io.Copy(w, reader)
+			buf := s.bufferPool.Get(DefaultCopyBufferBytes)
+			io.CopyBuffer(w, rewound, buf)
+			s.bufferPool.Put(buf)
 			return
 		}
 
@@ -267,7 +381,33 @@ func (s *Streamer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		outreq = s.copyRequest(req, body, totalSize)
 		s.log.Infof("retry Request(%v %v) attempt %v", req.Method, req.URL, attempt)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// retryPredicatePeekBytes is how far into the buffered response a Retry
+// predicate is allowed to look via ResponseBodyContains.
+const retryPredicatePeekBytes = 4096
+
+// peekReader reads up to n bytes from r for the Retry predicate to inspect,
+// and hands back a reader that reproduces the full stream (peeked bytes
+// followed by the remainder of r) so the eventual copy to the client sees
+// the response exactly as if it had never been peeked at.
+func peekReader(r io.Reader, n int) (peek []byte, rewound io.Reader, err error) {
+	peek = make([]byte, n)
+	read, err := io.ReadFull(r, peek)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
 	}
+	peek = peek[:read]
+	return peek, io.MultiReader(bytes.NewReader(peek), r), nil
 }
 
 func (s *Streamer) copyRequest(req *http.Request, body io.ReadCloser, bodySize int64) *http.Request {
@@ -329,7 +469,22 @@ type SizeErrHandler struct {
 func (e *SizeErrHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
 	if _, ok := err.(*multibuf.MaxSizeReachedError); ok {
 		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge) + ": compressed size limit exceeded"))
+		return
+	}
+	if _, ok := err.(*MaxDecodedSizeReachedError); ok {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge) + ": decoded size limit exceeded"))
+		return
+	}
+	if de, ok := err.(*DecodeError); ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(http.StatusText(http.StatusBadRequest) + ": " + de.Error()))
+		return
+	}
+	if err == ErrSpillNotSupported {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge) + ": " + err.Error()))
 		return
 	}
 	utils.DefaultHandler.ServeHTTP(w, req, err)
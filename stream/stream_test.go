@@ -0,0 +1,54 @@
+package stream
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mailgun/multibuf"
+)
+
+func TestSizeErrHandlerMapsMaxSizeReachedError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	(&SizeErrHandler{}).ServeHTTP(rec, req, &multibuf.MaxSizeReachedError{MaxSize: 10})
+	if rec.Code != 413 {
+		t.Fatalf("got status %d, want 413", rec.Code)
+	}
+}
+
+func TestSizeErrHandlerMapsMaxDecodedSizeReachedError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	(&SizeErrHandler{}).ServeHTTP(rec, req, &MaxDecodedSizeReachedError{MaxSize: 10})
+	if rec.Code != 413 {
+		t.Fatalf("got status %d, want 413", rec.Code)
+	}
+}
+
+func TestSizeErrHandlerMapsDecodeErrorToBadRequest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	(&SizeErrHandler{}).ServeHTTP(rec, req, &DecodeError{Encoding: "gzip", Err: errors.New("unexpected EOF")})
+	if rec.Code != 400 {
+		t.Fatalf("got status %d, want 400 for a malformed Content-Encoding body", rec.Code)
+	}
+}
+
+func TestSizeErrHandlerMapsErrSpillNotSupportedToRequestEntityTooLarge(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	(&SizeErrHandler{}).ServeHTTP(rec, req, ErrSpillNotSupported)
+	if rec.Code != 413 {
+		t.Fatalf("got status %d, want 413 when the body can't fit in memory and spilling isn't supported", rec.Code)
+	}
+}
+
+func TestSizeErrHandlerFallsBackToDefaultHandlerForUnrecognizedErrors(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", nil)
+	(&SizeErrHandler{}).ServeHTTP(rec, req, errors.New("some other failure"))
+	if rec.Code != 500 {
+		t.Fatalf("got status %d, want 500 for an unrecognized error", rec.Code)
+	}
+}
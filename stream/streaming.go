@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/mailgun/multibuf"
+	"github.com/mailgun/oxy/utils"
+)
+
+// DefaultChunkBufferBytes is the default size of the buffers used to relay
+// bodies in StreamingMode.
+const DefaultChunkBufferBytes = 20 * 1024 * 1024
+
+// StreamingMode enables pass-through streaming of requests and responses.
+// Instead of spooling the whole body to memory or disk via multibuf, the
+// request body is wrapped in a guard that enforces MaxRequestBodyBytes
+// incrementally and the response is relayed to the client through a
+// reusable chunk buffer, so large uploads and downloads (log ingestion,
+// file uploads, gRPC-style streams) don't need gigabytes of scratch space.
+//
+// StreamingMode takes no effect while a Retry predicate is configured,
+// since replaying a request requires the original body to be captured in
+// full; the streamer falls back to the regular buffering behavior instead.
+//
+// MaxDecodedRequestBodyBytes and MaxDecodedResponseBodyBytes aren't
+// enforced in StreamingMode: only the raw, on-the-wire limits are.
+func StreamingMode(enabled bool) optSetter {
+	return func(s *Streamer) error {
+		s.streamingMode = enabled
+		return nil
+	}
+}
+
+// ChunkBufferBytes sets the size of the buffers used to relay request and
+// response bodies in StreamingMode. Buffers of this size are drawn from the
+// Streamer's BufferPool and reused across requests.
+func ChunkBufferBytes(b int) optSetter {
+	return func(s *Streamer) error {
+		if b <= 0 {
+			return fmt.Errorf("chunk buffer bytes should be > 0 got %d", b)
+		}
+		s.chunkBufferBytes = b
+		return nil
+	}
+}
+
+// limitedReader enforces a maximum number of bytes that can be read from r,
+// failing with MaxSizeReachedError as soon as the caller reads past max
+// bytes, without buffering what it has already seen.
+type limitedReader struct {
+	r    io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.max > 0 {
+		if l.read >= l.max {
+			// Only fail if there's actually a byte past max to read.
+			var one [1]byte
+			if n, err := l.r.Read(one[:]); n == 0 {
+				return 0, err
+			}
+			return 0, &multibuf.MaxSizeReachedError{MaxSize: l.max}
+		}
+		if remaining := l.max - l.read; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+func (l *limitedReader) Close() error {
+	return l.r.Close()
+}
+
+// streamWriter relays a handler's writes to the real http.ResponseWriter
+// through a fixed-size buffer drawn from a BufferPool, flushing once the
+// buffer fills up or the handler calls Flush explicitly. Header and
+// Trailer both pass straight through to rw, so handlers that announce a
+// Trailer the usual net/http way keep working unmodified.
+type streamWriter struct {
+	rw      http.ResponseWriter
+	pool    BufferPool
+	buf     []byte
+	fill    int
+	max     int64
+	written int64
+}
+
+func newStreamWriter(rw http.ResponseWriter, pool BufferPool, chunkBytes int, max int64) *streamWriter {
+	return &streamWriter{rw: rw, pool: pool, buf: pool.Get(chunkBytes), max: max}
+}
+
+func (s *streamWriter) Header() http.Header {
+	return s.rw.Header()
+}
+
+func (s *streamWriter) WriteHeader(code int) {
+	s.rw.WriteHeader(code)
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if s.max > 0 && s.written+int64(s.fill)+int64(len(p)) > s.max {
+			return total, &multibuf.MaxSizeReachedError{MaxSize: s.max}
+		}
+		n := copy(s.buf[s.fill:], p)
+		s.fill += n
+		p = p[n:]
+		total += n
+		if s.fill == len(s.buf) {
+			if err := s.flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (s *streamWriter) flush() error {
+	if s.fill == 0 {
+		return nil
+	}
+	n, err := s.rw.Write(s.buf[:s.fill])
+	s.written += int64(n)
+	s.fill = 0
+	return err
+}
+
+// Flush implements http.Flusher so downstream handlers that stream partial
+// results (log tails, SSE, gRPC-Web) see bytes reach the client as they're
+// written instead of waiting for the chunk buffer to fill up.
+func (s *streamWriter) Flush() {
+	s.flush()
+	if f, ok := s.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *streamWriter) Close() error {
+	err := s.flush()
+	s.pool.Put(s.buf)
+	s.buf = nil
+	return err
+}
+
+func (s *Streamer) serveStreaming(w http.ResponseWriter, req *http.Request) {
+	if err := s.checkLimit(req); err != nil {
+		s.log.Infof("request body over limit: %v", err)
+		s.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+
+	o := *req
+	o.URL = utils.CopyURL(req.URL)
+	o.Header = make(http.Header)
+	utils.CopyHeaders(o.Header, req.Header)
+	o.Trailer = req.Trailer
+	o.Body = &limitedReader{r: req.Body, max: s.maxRequestBodyBytes}
+
+	sw := newStreamWriter(w, s.bufferPool, s.chunkBufferBytes, s.maxResponseBodyBytes)
+	defer sw.Close()
+
+	s.next.ServeHTTP(sw, &o)
+}
@@ -0,0 +1,174 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mailgun/multibuf"
+)
+
+func TestLimitedReaderAllowsWithinLimit(t *testing.T) {
+	l := &limitedReader{r: ioutil.NopCloser(bytes.NewReader([]byte("hello"))), max: 10}
+	got, err := ioutil.ReadAll(l)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestLimitedReaderRejectsOverLimit(t *testing.T) {
+	l := &limitedReader{r: ioutil.NopCloser(bytes.NewReader([]byte("hello world"))), max: 5}
+	_, err := ioutil.ReadAll(l)
+	if _, ok := err.(*multibuf.MaxSizeReachedError); !ok {
+		t.Fatalf("expected MaxSizeReachedError, got %v", err)
+	}
+}
+
+func TestLimitedReaderUnlimitedByDefault(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	l := &limitedReader{r: ioutil.NopCloser(bytes.NewReader(data)), max: 0}
+	got, err := ioutil.ReadAll(l)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// flushRecorder wraps httptest.ResponseRecorder to count Flush calls, since
+// streamWriter.Flush should forward to the underlying http.Flusher.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestStreamWriterBuffersUntilFull(t *testing.T) {
+	rec := httptest.NewRecorder()
+	pool := NewBufferPool()
+	sw := newStreamWriter(rec, pool, 8, 0)
+
+	if _, err := sw.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("expected nothing flushed yet, got %q", rec.Body.String())
+	}
+
+	// pushes the buffer (8 bytes) over its limit, forcing a flush of the first chunk
+	if _, err := sw.Write([]byte("defghijk")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if rec.Body.String() != "abcdefghijk" {
+		t.Fatalf("got %q, want %q", rec.Body.String(), "abcdefghijk")
+	}
+}
+
+func TestStreamWriterEnforcesMaxResponseBodyBytes(t *testing.T) {
+	rec := httptest.NewRecorder()
+	pool := NewBufferPool()
+	sw := newStreamWriter(rec, pool, 1024, 5)
+
+	if _, err := sw.Write([]byte("1234")); err != nil {
+		t.Fatalf("unexpected error within limit: %v", err)
+	}
+	_, err := sw.Write([]byte("56789"))
+	if _, ok := err.(*multibuf.MaxSizeReachedError); !ok {
+		t.Fatalf("expected MaxSizeReachedError, got %v", err)
+	}
+}
+
+func TestStreamWriterFlushForwardsToFlusher(t *testing.T) {
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	pool := NewBufferPool()
+	sw := newStreamWriter(rec, pool, 1024, 0)
+
+	sw.Write([]byte("partial"))
+	sw.Flush()
+
+	if rec.Body.String() != "partial" {
+		t.Fatalf("expected Flush to push buffered bytes through, got %q", rec.Body.String())
+	}
+	if rec.flushes != 1 {
+		t.Fatalf("expected the underlying Flusher to be called once, got %d", rec.flushes)
+	}
+}
+
+func TestStreamWriterClosePutsBufferBackInPool(t *testing.T) {
+	rec := httptest.NewRecorder()
+	pool := NewBufferPool()
+	sw := newStreamWriter(rec, pool, 1024, 0)
+	sw.Write([]byte("x"))
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if sw.buf != nil {
+		t.Fatal("expected Close to release the buffer back to the pool")
+	}
+}
+
+func TestServeStreamingRelaysBodyAndTrailer(t *testing.T) {
+	var gotTrailer http.Header
+	var gotBody []byte
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotTrailer = req.Trailer
+		gotBody, _ = ioutil.ReadAll(req.Body)
+		io.Copy(w, bytes.NewReader(gotBody))
+	})
+
+	s, err := New(next, StreamingMode(true), ChunkBufferBytes(64*1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("streamed body")))
+	req.Trailer = http.Header{"X-Trailer": []string{"done"}}
+	rec := httptest.NewRecorder()
+
+	s.ServeHTTP(rec, req)
+
+	if !bytes.Equal(gotBody, []byte("streamed body")) {
+		t.Fatalf("handler saw body %q, want %q", gotBody, "streamed body")
+	}
+	if gotTrailer.Get("X-Trailer") != "done" {
+		t.Fatalf("expected the request Trailer to be relayed to the handler, got %v", gotTrailer)
+	}
+	if rec.Body.String() != "streamed body" {
+		t.Fatalf("client saw body %q, want %q", rec.Body.String(), "streamed body")
+	}
+}
+
+func TestServeStreamingRejectsOversizedContentLength(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Fatal("handler should not be invoked once checkLimit rejects the request")
+	})
+
+	s, err := New(next, StreamingMode(true), ChunkBufferBytes(64*1024), MaxRequestBodyBytes(4))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte("too big")))
+	req.ContentLength = int64(len("too big"))
+	rec := httptest.NewRecorder()
+
+	s.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}